@@ -0,0 +1,196 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Defaults for locating nfd-master when --server is not given, matching the
+// values used by the NFD chart.
+const (
+	defaultMasterService   = "nfd-master"
+	defaultMasterNamespace = "openshift-nfd"
+)
+
+// buildRestConfig returns a Kubernetes REST config, preferring an explicit
+// kubeconfig file and falling back to the in-cluster ServiceAccount config.
+func buildRestConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
+
+// resolveMasterAddress looks up the nfd-master Service and returns its
+// ClusterIP:port.
+func resolveMasterAddress(client kubernetes.Interface, namespace, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	svc, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get nfd-master service %s/%s: %v", namespace, name, err)
+	}
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == "None" {
+		return "", fmt.Errorf("service %s/%s has no usable ClusterIP", namespace, name)
+	}
+
+	var port int32
+	for _, p := range svc.Spec.Ports {
+		if p.Name == "grpc" {
+			port = p.Port
+			break
+		}
+	}
+	if port == 0 && len(svc.Spec.Ports) > 0 {
+		port = svc.Spec.Ports[0].Port
+	}
+	if port == 0 {
+		return "", fmt.Errorf("service %s/%s exposes no ports", namespace, name)
+	}
+
+	return fmt.Sprintf("%s:%d", svc.Spec.ClusterIP, port), nil
+}
+
+// bearerTokenCreds implements grpc/credentials.PerRPCCredentials, re-reading
+// tokenFile on every call so that a rotated, projected ServiceAccount token
+// is picked up without having to re-dial.
+type bearerTokenCreds struct {
+	token     string
+	tokenFile string
+}
+
+func (c *bearerTokenCreds) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ServiceAccount token %q: %v", c.tokenFile, err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (c *bearerTokenCreds) RequireTransportSecurity() bool { return true }
+
+// discoverMaster resolves the nfd-master address from the Kubernetes API,
+// using the in-cluster ServiceAccount (or a --kubeconfig file) for both
+// discovery and the gRPC transport credentials, and starts watching the
+// nfd-master Endpoints so that w.masterEvents fires on rescheduling.
+func (w *nfdWorker) discoverMaster() (string, []grpc.DialOption, error) {
+	restConfig, err := buildRestConfig(w.args.Kubeconfig)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to build Kubernetes client config: %v", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
+	}
+
+	namespace := w.args.MasterNamespace
+	if namespace == "" {
+		namespace = defaultMasterNamespace
+	}
+	service := w.args.MasterService
+	if service == "" {
+		service = defaultMasterService
+	}
+
+	addr, err := resolveMasterAddress(client, namespace, service)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pool := x509.NewCertPool()
+	haveCA := false
+	if len(restConfig.CAData) > 0 {
+		haveCA = pool.AppendCertsFromPEM(restConfig.CAData)
+	} else if restConfig.CAFile != "" {
+		data, err := ioutil.ReadFile(restConfig.CAFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read ServiceAccount CA bundle: %v", err)
+		}
+		haveCA = pool.AppendCertsFromPEM(data)
+	}
+	// nfd-master's serving certificate is issued for the in-cluster Service
+	// DNS name, not the dynamically-assigned ClusterIP we dial, so the
+	// handshake must verify against that name explicitly.
+	tlsConfig := &tls.Config{ServerName: fmt.Sprintf("%s.%s.svc", service, namespace)}
+	if haveCA {
+		tlsConfig.RootCAs = pool
+	}
+
+	creds := &bearerTokenCreds{token: restConfig.BearerToken, tokenFile: restConfig.BearerTokenFile}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithPerRPCCredentials(creds),
+	}
+
+	w.watchMasterEndpoints(client, namespace, service)
+
+	return addr, opts, nil
+}
+
+// watchMasterEndpoints watches the nfd-master Endpoints object and signals
+// w.masterEvents whenever it changes, e.g. because nfd-master was
+// rescheduled to a different node. It is a no-op if already watching.
+func (w *nfdWorker) watchMasterEndpoints(client kubernetes.Interface, namespace, name string) {
+	if w.masterEvents != nil {
+		return
+	}
+	events := make(chan struct{}, 1)
+	w.masterEvents = events
+
+	go func() {
+		for {
+			watcher, err := client.CoreV1().Endpoints(namespace).Watch(context.Background(), metav1.ListOptions{
+				FieldSelector: fmt.Sprintf("metadata.name=%s", name),
+			})
+			if err != nil {
+				stderrLogger.Printf("ERROR: failed to watch nfd-master endpoints %s/%s: %v", namespace, name, err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			ch := watcher.ResultChan()
+			for range ch {
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+			// The channel was closed, e.g. due to a watch timeout; restart it.
+			watcher.Stop()
+		}
+	}()
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveMasterAddress(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "nfd-master", Namespace: "openshift-nfd"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: "10.0.0.42",
+			Ports: []corev1.ServicePort{
+				{Name: "metrics", Port: 8081},
+				{Name: "grpc", Port: 8080},
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(svc)
+
+	addr, err := resolveMasterAddress(client, "openshift-nfd", "nfd-master")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != "10.0.0.42:8080" {
+		t.Errorf("expected the named 'grpc' port to be picked, got %q", addr)
+	}
+}
+
+func TestResolveMasterAddressNoClusterIP(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "nfd-master", Namespace: "openshift-nfd"},
+		Spec:       corev1.ServiceSpec{ClusterIP: "None", Ports: []corev1.ServicePort{{Port: 8080}}},
+	}
+	client := fake.NewSimpleClientset(svc)
+
+	if _, err := resolveMasterAddress(client, "openshift-nfd", "nfd-master"); err == nil {
+		t.Error("expected an error for a headless service")
+	}
+}
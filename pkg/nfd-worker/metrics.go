@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "nfd_worker"
+
+// workerMetrics holds the Prometheus instrumentation for the worker
+// discovery loop. All methods are nil-receiver safe so that callers don't
+// need to special-case the metrics-disabled path.
+type workerMetrics struct {
+	registry *prometheus.Registry
+
+	sourceDiscoveryDuration *prometheus.HistogramVec
+	sourceErrors            *prometheus.CounterVec
+	labelsTotal             prometheus.Counter
+	labelsFiltered          prometheus.Counter
+	setLabelsDuration       prometheus.Histogram
+	grpcConnected           prometheus.Gauge
+	configReloadsTotal      prometheus.Counter
+}
+
+// newWorkerMetrics creates and registers the worker metrics on a dedicated
+// registry, so that enabling metrics never touches the global
+// prometheus.DefaultRegisterer.
+func newWorkerMetrics() *workerMetrics {
+	m := &workerMetrics{
+		registry: prometheus.NewRegistry(),
+		sourceDiscoveryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "source_discovery_seconds",
+			Help:      "Duration of feature discovery per source.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"source"}),
+		sourceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "source_errors_total",
+			Help:      "Number of discovery errors, including recovered panics, per source.",
+		}, []string{"source"}),
+		labelsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "labels_total",
+			Help:      "Number of feature labels produced and passed to nfd-master.",
+		}),
+		labelsFiltered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "labels_filtered_total",
+			Help:      "Number of discovered features dropped by the label whitelist.",
+		}),
+		setLabelsDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "set_labels_duration_seconds",
+			Help:      "Duration of the SetLabels gRPC round-trip to nfd-master.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		grpcConnected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_connected",
+			Help:      "Whether the worker currently holds a connection to nfd-master (1) or not (0).",
+		}),
+		configReloadsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_reloads_total",
+			Help:      "Number of configuration reloads triggered by the fsnotify watch.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.sourceDiscoveryDuration,
+		m.sourceErrors,
+		m.labelsTotal,
+		m.labelsFiltered,
+		m.setLabelsDuration,
+		m.grpcConnected,
+		m.configReloadsTotal,
+	)
+	return m
+}
+
+// serve launches the metrics HTTP endpoint on address in its own goroutine,
+// returning the server so the caller can shut it down.
+func (m *workerMetrics) serve(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			stderrLogger.Printf("ERROR: metrics server failed: %v", err)
+		}
+	}()
+	return srv
+}
+
+func (m *workerMetrics) observeSourceDiscovery(source string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.sourceDiscoveryDuration.WithLabelValues(source).Observe(d.Seconds())
+}
+
+func (m *workerMetrics) incSourceError(source string) {
+	if m == nil {
+		return
+	}
+	m.sourceErrors.WithLabelValues(source).Inc()
+}
+
+func (m *workerMetrics) addLabelsProduced(n int) {
+	if m == nil {
+		return
+	}
+	m.labelsTotal.Add(float64(n))
+}
+
+func (m *workerMetrics) incLabelFiltered() {
+	if m == nil {
+		return
+	}
+	m.labelsFiltered.Inc()
+}
+
+func (m *workerMetrics) observeSetLabels(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.setLabelsDuration.Observe(d.Seconds())
+}
+
+func (m *workerMetrics) setGRPCConnected(connected bool) {
+	if m == nil {
+		return
+	}
+	if connected {
+		m.grpcConnected.Set(1)
+	} else {
+		m.grpcConnected.Set(0)
+	}
+}
+
+func (m *workerMetrics) incConfigReload() {
+	if m == nil {
+		return
+	}
+	m.configReloadsTotal.Inc()
+}
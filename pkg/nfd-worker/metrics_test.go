@@ -0,0 +1,89 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWorkerMetrics(t *testing.T) {
+	m := newWorkerMetrics()
+
+	m.observeSourceDiscovery("cpu", 10*time.Millisecond)
+	m.incSourceError("cpu")
+	m.addLabelsProduced(3)
+	m.incLabelFiltered()
+	m.observeSetLabels(5 * time.Millisecond)
+	m.setGRPCConnected(true)
+	m.incConfigReload()
+
+	if n := testutil.CollectAndCount(m.sourceErrors); n != 1 {
+		t.Errorf("expected 1 source_errors series, got %d", n)
+	}
+	if v := testutil.ToFloat64(m.labelsTotal); v != 3 {
+		t.Errorf("expected labelsTotal to be 3, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.labelsFiltered); v != 1 {
+		t.Errorf("expected labelsFiltered to be 1, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.grpcConnected); v != 1 {
+		t.Errorf("expected grpcConnected to be 1, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.configReloadsTotal); v != 1 {
+		t.Errorf("expected configReloadsTotal to be 1, got %v", v)
+	}
+}
+
+// TestWorkerMetricsNilSafe verifies that a nil *workerMetrics, used when
+// metrics are disabled, is a no-op rather than a crash.
+func TestWorkerMetricsNilSafe(t *testing.T) {
+	var m *workerMetrics
+
+	m.observeSourceDiscovery("cpu", time.Millisecond)
+	m.incSourceError("cpu")
+	m.addLabelsProduced(1)
+	m.incLabelFiltered()
+	m.observeSetLabels(time.Millisecond)
+	m.setGRPCConnected(true)
+	m.incConfigReload()
+}
+
+func TestWorkerMetricsServe(t *testing.T) {
+	m := newWorkerMetrics()
+	m.addLabelsProduced(2)
+
+	srv := m.serve("127.0.0.1:0")
+	defer srv.Close()
+
+	// serve() binds asynchronously via ListenAndServe, which only logs on
+	// failure, so exercise the handler directly instead of over the network.
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("expected HTTP 200 from /metrics, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "nfd_worker_labels_total 2") {
+		t.Fatalf("expected labels_total sample in metrics output, got:\n%s", rec.Body.String())
+	}
+}
@@ -18,7 +18,6 @@ package nfdworker
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -34,6 +33,22 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"k8s.io/apimachinery/pkg/util/validation"
+	pb "sigs.k8s.io/node-feature-discovery/pkg/labeler"
+	"sigs.k8s.io/node-feature-discovery/pkg/version"
+	"sigs.k8s.io/node-feature-discovery/source"
+	"sigs.k8s.io/node-feature-discovery/source/cpu"
+	"sigs.k8s.io/node-feature-discovery/source/custom"
+	"sigs.k8s.io/node-feature-discovery/source/fake"
+	"sigs.k8s.io/node-feature-discovery/source/iommu"
+	"sigs.k8s.io/node-feature-discovery/source/kernel"
+	"sigs.k8s.io/node-feature-discovery/source/local"
+	"sigs.k8s.io/node-feature-discovery/source/memory"
+	"sigs.k8s.io/node-feature-discovery/source/network"
+	panicfake "sigs.k8s.io/node-feature-discovery/source/panic_fake"
+	"sigs.k8s.io/node-feature-discovery/source/pci"
+	"sigs.k8s.io/node-feature-discovery/source/storage"
+	"sigs.k8s.io/node-feature-discovery/source/system"
+	"sigs.k8s.io/node-feature-discovery/source/usb"
 	"sigs.k8s.io/yaml"
 )
 
@@ -62,11 +77,17 @@ type Labels map[string]string
 type Args struct {
 	LabelWhiteList     string
 	CaFile             string
+	CaBundleDir        string
 	CertFile           string
 	KeyFile            string
 	ConfigFile         string
+	Kubeconfig         string
+	MasterNamespace    string
+	MasterService      string
 	Options            string
+	MetricsAddress     string
 	Oneshot            bool
+	PluginsDir         string
 	Server             string
 	ServerNameOverride string
 	SleepInterval      time.Duration
@@ -87,14 +108,25 @@ type nfdWorker struct {
 	config         *NFDConfig
 	sources        []source.FeatureSource
 	labelWhiteList *regexp.Regexp
+	tlsCache       *tlsCache
+	metrics        *workerMetrics
+	masterEvents   chan struct{}
 }
 
 // Create new NfdWorker instance.
 func NewNfdWorker(args Args) (NfdWorker, error) {
 	nfd := &nfdWorker{
-		args:    args,
-		config:  &NFDConfig{},
-		sources: []source.FeatureSource{},
+		args:     args,
+		config:   &NFDConfig{},
+		sources:  []source.FeatureSource{},
+		tlsCache: &tlsCache{},
+	}
+
+	// Metrics are pluggable and skipped for the Oneshot path, where a
+	// single-shot process exiting right after one label update has no use
+	// for a long-lived HTTP endpoint.
+	if args.MetricsAddress != "" && !args.Oneshot {
+		nfd.metrics = newWorkerMetrics()
 	}
 
 	if args.ConfigFile != "" {
@@ -131,11 +163,21 @@ func NewNfdWorker(args Args) (NfdWorker, error) {
 		&system.Source{},
 		&usb.Source{},
 		&custom.Source{},
-		// local needs to be the last source so that it is able to override
-		// labels from other sources
-		&local.Source{},
 	}
 
+	// Load any user-supplied plugins and make them available alongside the
+	// compiled-in sources. Plugins are appended before the source whitelist
+	// is applied so they can be enabled/disabled the same way as built-in
+	// sources via --sources or the whitelist, and before local so that local
+	// still gets the final say below.
+	if args.PluginsDir != "" {
+		allSources = append(allSources, loadPlugins(args.PluginsDir)...)
+	}
+
+	// local needs to be the last source so that it is able to override
+	// labels from other sources, including plugins
+	allSources = append(allSources, &local.Source{})
+
 	// Determine enabled feature
 	if len(args.Sources) == 1 && args.Sources[0] == "all" {
 		nfd.sources = allSources
@@ -176,7 +218,10 @@ func NewNfdWorker(args Args) (NfdWorker, error) {
 	return nfd, nil
 }
 
-func addConfigWatch(path string) (*fsnotify.Watcher, map[string]struct{}, error) {
+// addFsWatch creates a fsnotify watcher covering the given targets, adding
+// watches for all of their parent directory components too so that renames
+// or recreations further up the tree are caught as well.
+func addFsWatch(targets []string) (*fsnotify.Watcher, map[string]struct{}, error) {
 	paths := make(map[string]struct{})
 
 	// Create watcher
@@ -185,31 +230,48 @@ func addConfigWatch(path string) (*fsnotify.Watcher, map[string]struct{}, error)
 		return w, paths, fmt.Errorf("failed to create fsnotify watcher: %v", err)
 	}
 
-	// Add watches for all directory components so that we catch e.g. renames
-	// upper in the tree
 	added := false
-	for p := path; ; p = filepath.Dir(p) {
-
-		if err := w.Add(p); err != nil {
-			stdoutLogger.Printf("failed to add fsnotify watch for %q: %v", p, err)
-		} else {
-			stdoutLogger.Printf("added fsnotify watch %q", p)
-			added = true
-		}
-
-		paths[p] = struct{}{}
-		if filepath.Dir(p) == p {
-			break
+	for _, target := range targets {
+		for p := target; ; p = filepath.Dir(p) {
+			if _, ok := paths[p]; !ok {
+				if err := w.Add(p); err != nil {
+					stdoutLogger.Printf("failed to add fsnotify watch for %q: %v", p, err)
+				} else {
+					stdoutLogger.Printf("added fsnotify watch %q", p)
+					added = true
+				}
+				paths[p] = struct{}{}
+			}
+			if filepath.Dir(p) == p {
+				break
+			}
 		}
 	}
 
-	if !added {
+	if len(targets) > 0 && !added {
 		// Want to be sure that we watch something
 		return w, paths, fmt.Errorf("failed to add any watch")
 	}
 	return w, paths, nil
 }
 
+func addConfigWatch(path string) (*fsnotify.Watcher, map[string]struct{}, error) {
+	return addFsWatch([]string{path})
+}
+
+// addCertWatch sets up a fsnotify watch covering the TLS keypair, CA file
+// and CA bundle directory, if configured, so that cert rotation can be
+// picked up without a worker restart.
+func addCertWatch(args Args) (*fsnotify.Watcher, map[string]struct{}, error) {
+	targets := []string{}
+	for _, p := range []string{args.CertFile, args.KeyFile, args.CaFile, args.CaBundleDir} {
+		if p != "" {
+			targets = append(targets, filepath.Clean(p))
+		}
+	}
+	return addFsWatch(targets)
+}
+
 func newDefaultConfig() *NFDConfig {
 	return &NFDConfig{
 		Core: coreConfig{},
@@ -229,6 +291,19 @@ func (w *nfdWorker) Run() error {
 	}
 	w.configure(w.configFilePath, w.args.Options)
 
+	// Create watcher for the TLS keypair, CA file and CA bundle directory
+	certWatch, certPaths, err := addCertWatch(w.args)
+	if err != nil {
+		return err
+	}
+	defer certWatch.Close()
+
+	// Launch the metrics HTTP endpoint, if enabled
+	if w.metrics != nil {
+		metricsSrv := w.metrics.serve(w.args.MetricsAddress)
+		defer metricsSrv.Close()
+	}
+
 	// Connect to NFD master
 	err = w.connect()
 	if err != nil {
@@ -238,15 +313,16 @@ func (w *nfdWorker) Run() error {
 
 	labelTrigger := time.After(0)
 	var configTrigger <-chan time.Time
+	var certTrigger <-chan time.Time
 	for {
 		select {
 		case <-labelTrigger:
 			// Get the set of feature labels.
-			labels := createFeatureLabels(w.sources, w.labelWhiteList)
+			labels := createFeatureLabels(w.sources, w.labelWhiteList, w.metrics)
 
 			// Update the node with the feature labels.
 			if w.client != nil {
-				err := advertiseFeatureLabels(w.client, labels)
+				err := advertiseFeatureLabels(w.client, labels, w.metrics)
 				if err != nil {
 					return fmt.Errorf("failed to advertise labels: %s", err.Error())
 				}
@@ -287,6 +363,7 @@ func (w *nfdWorker) Run() error {
 
 		case <-configTrigger:
 			w.configure(w.configFilePath, w.args.Options)
+			w.metrics.incConfigReload()
 			// Manage connection to master
 			if w.config.Core.NoPublish {
 				w.disconnect()
@@ -298,6 +375,39 @@ func (w *nfdWorker) Run() error {
 			// Always re-label after a re-config event. This way the new config
 			// comes into effect even if the sleep interval is long (or infinite)
 			labelTrigger = time.After(0)
+
+		case e := <-certWatch.Events:
+			name := filepath.Clean(e.Name)
+
+			if _, ok := certPaths[name]; ok {
+				stdoutLogger.Printf("fsnotify event in %q detected, reconfiguring fsnotify and reloading TLS material", name)
+
+				if err := certWatch.Close(); err != nil {
+					stderrLogger.Printf("WARNING: failed to close fsnotify watcher: %v", err)
+				}
+				certWatch, certPaths, err = addCertWatch(w.args)
+				if err != nil {
+					return err
+				}
+
+				// Rate limiter, see the config file watch above
+				certTrigger = time.After(time.Second)
+			}
+
+		case e := <-certWatch.Errors:
+			stderrLogger.Printf("ERROR: TLS material watcher error: %v", e)
+
+		case <-certTrigger:
+			if err := w.reloadTLS(); err != nil {
+				stderrLogger.Printf("WARNING: failed to reload TLS material: %v", err)
+			}
+
+		case <-w.masterEvents:
+			stdoutLogger.Printf("nfd-master endpoints changed, reconnecting")
+			w.disconnect()
+			if err := w.connect(); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -318,37 +428,46 @@ func (w *nfdWorker) connect() error {
 	dialCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 	dialOpts := []grpc.DialOption{grpc.WithBlock()}
-	if w.args.CaFile != "" || w.args.CertFile != "" || w.args.KeyFile != "" {
-		// Load client cert for client authentication
-		cert, err := tls.LoadX509KeyPair(w.args.CertFile, w.args.KeyFile)
+
+	server := w.args.Server
+	if server == "" {
+		// No --server given: discover nfd-master through the Kubernetes API
+		// instead, reusing the ServiceAccount credentials for transport.
+		addr, opts, err := w.discoverMaster()
 		if err != nil {
-			return fmt.Errorf("failed to load client certificate: %v", err)
+			return fmt.Errorf("failed to discover nfd-master: %v", err)
 		}
-		// Load CA cert for server cert verification
-		caCert, err := ioutil.ReadFile(w.args.CaFile)
+		server = addr
+		dialOpts = append(dialOpts, opts...)
+	} else if w.args.CaFile != "" || w.args.CertFile != "" || w.args.KeyFile != "" {
+		cert, pool, caPEM, err := loadTLSMaterial(w.args.CertFile, w.args.KeyFile, w.args.CaFile, w.args.CaBundleDir)
 		if err != nil {
-			return fmt.Errorf("failed to read root certificate file: %v", err)
-		}
-		caPool := x509.NewCertPool()
-		if ok := caPool.AppendCertsFromPEM(caCert); !ok {
-			return fmt.Errorf("failed to add certificate from '%s'", w.args.CaFile)
+			return err
 		}
-		// Create TLS config
+		w.tlsCache.update(cert, pool, caPEM)
+
+		// The client certificate and CA pool are looked up from w.tlsCache on
+		// every handshake, so a certificate rotation picked up by reloadTLS
+		// takes effect without having to re-dial.
 		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      caPool,
-			ServerName:   w.args.ServerNameOverride,
+			GetClientCertificate: w.tlsCache.getClientCertificate,
+			// Verification is done in VerifyConnection against the live CA
+			// pool instead of the one captured here at dial time.
+			InsecureSkipVerify: true,
+			VerifyConnection:   w.tlsCache.verifyConnection,
+			ServerName:         w.args.ServerNameOverride,
 		}
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
 	}
-	conn, err := grpc.DialContext(dialCtx, w.args.Server, dialOpts...)
+	conn, err := grpc.DialContext(dialCtx, server, dialOpts...)
 	if err != nil {
 		return err
 	}
 	w.clientConn = conn
 	w.client = pb.NewLabelerClient(conn)
+	w.metrics.setGRPCConnected(true)
 
 	return nil
 }
@@ -358,10 +477,35 @@ func (w *nfdWorker) disconnect() {
 	if w.clientConn != nil {
 		w.clientConn.Close()
 	}
+	w.metrics.setGRPCConnected(false)
 	w.clientConn = nil
 	w.client = nil
 }
 
+// reloadTLS re-reads the TLS keypair and CA pool from disk and swaps them
+// into the live tls.Config callbacks used by the gRPC connection. If the
+// trusted CA pool changed, the connection to nfd-master is re-dialed so
+// that the new trust root is honored immediately.
+func (w *nfdWorker) reloadTLS() error {
+	if w.args.CertFile == "" && w.args.KeyFile == "" && w.args.CaFile == "" {
+		return nil
+	}
+
+	cert, pool, caPEM, err := loadTLSMaterial(w.args.CertFile, w.args.KeyFile, w.args.CaFile, w.args.CaBundleDir)
+	if err != nil {
+		return fmt.Errorf("failed to reload TLS material: %v", err)
+	}
+	caChanged := w.tlsCache.update(cert, pool, caPEM)
+	stdoutLogger.Printf("TLS keypair and CA pool reloaded from disk")
+
+	if caChanged && w.clientConn != nil {
+		stdoutLogger.Printf("trusted CA pool changed, reconnecting to nfd-master")
+		w.disconnect()
+		return w.connect()
+	}
+	return nil
+}
+
 // Parse configuration options
 func (w *nfdWorker) configure(filepath string, overrides string) {
 	// Create a new default config
@@ -404,12 +548,12 @@ func (w *nfdWorker) configure(filepath string, overrides string) {
 
 // createFeatureLabels returns the set of feature labels from the enabled
 // sources and the whitelist argument.
-func createFeatureLabels(sources []source.FeatureSource, labelWhiteList *regexp.Regexp) (labels Labels) {
+func createFeatureLabels(sources []source.FeatureSource, labelWhiteList *regexp.Regexp, metrics *workerMetrics) (labels Labels) {
 	labels = Labels{}
 
 	// Do feature discovery from all configured sources.
 	for _, source := range sources {
-		labelsFromSource, err := getFeatureLabels(source, labelWhiteList)
+		labelsFromSource, err := getFeatureLabels(source, labelWhiteList, metrics)
 		if err != nil {
 			stderrLogger.Printf("discovery failed for source [%s]: %s", source.Name(), err.Error())
 			stderrLogger.Printf("continuing ...")
@@ -422,22 +566,27 @@ func createFeatureLabels(sources []source.FeatureSource, labelWhiteList *regexp.
 			labels[name] = value
 		}
 	}
+	metrics.addLabelsProduced(len(labels))
 	return labels
 }
 
 // getFeatureLabels returns node labels for features discovered by the
 // supplied source.
-func getFeatureLabels(source source.FeatureSource, labelWhiteList *regexp.Regexp) (labels Labels, err error) {
+func getFeatureLabels(source source.FeatureSource, labelWhiteList *regexp.Regexp, metrics *workerMetrics) (labels Labels, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			stderrLogger.Printf("panic occurred during discovery of source [%s]: %v", source.Name(), r)
+			metrics.incSourceError(source.Name())
 			err = fmt.Errorf("%v", r)
 		}
 	}()
 
+	start := time.Now()
 	labels = Labels{}
 	features, err := source.Discover()
+	metrics.observeSourceDiscovery(source.Name(), time.Since(start))
 	if err != nil {
+		metrics.incSourceError(source.Name())
 		return nil, err
 	}
 
@@ -483,6 +632,7 @@ func getFeatureLabels(source source.FeatureSource, labelWhiteList *regexp.Regexp
 		// Skip if label doesn't match labelWhiteList
 		if !labelWhiteList.MatchString(nameForWhiteListing) {
 			stderrLogger.Printf("%q does not match the whitelist (%s) and will not be published.", nameForWhiteListing, labelWhiteList.String())
+			metrics.incLabelFiltered()
 			continue
 		}
 
@@ -493,7 +643,7 @@ func getFeatureLabels(source source.FeatureSource, labelWhiteList *regexp.Regexp
 
 // advertiseFeatureLabels advertises the feature labels to a Kubernetes node
 // via the NFD server.
-func advertiseFeatureLabels(client pb.LabelerClient, labels Labels) error {
+func advertiseFeatureLabels(client pb.LabelerClient, labels Labels, metrics *workerMetrics) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -502,7 +652,9 @@ func advertiseFeatureLabels(client pb.LabelerClient, labels Labels) error {
 	labelReq := pb.SetLabelsRequest{Labels: labels,
 		NfdVersion: version.Get(),
 		NodeName:   nodeName}
+	start := time.Now()
 	_, err := client.SetLabels(ctx, &labelReq)
+	metrics.observeSetLabels(time.Since(start))
 	if err != nil {
 		stderrLogger.Printf("failed to set node labels: %v", err)
 		return err
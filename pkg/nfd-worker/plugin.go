@@ -0,0 +1,287 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/traefik/yaegi/interp"
+	"github.com/traefik/yaegi/stdlib"
+	"sigs.k8s.io/node-feature-discovery/source"
+)
+
+// pluginDiscoverTimeout bounds how long an interpreted plugin's Discover is
+// allowed to run. Unlike the compiled-in sources, this is untrusted,
+// drop-in-a-directory code - a plugin that blocks (a hung exec.Command, a
+// read that never returns) must degrade to a logged timeout instead of
+// wedging Run()'s event loop, since Discover is called synchronously from
+// the labelTrigger case.
+const pluginDiscoverTimeout = 10 * time.Second
+
+// pluginPackage is the package name every plugin source file must declare.
+// It lets us address the exported symbols (Discover, Name, NewConfig,
+// SetConfig) without having to parse the file to learn its package name.
+const pluginPackage = "plugin"
+
+// pluginStdlib restricts the standard library surface available to
+// interpreted plugins to what is needed to read /proc, /sys, run
+// exec.Command and return labels. Packages that are read-only discovery
+// helpers by nature are imported in full; os and io/ioutil are curated down
+// to individual read-only symbols so a plugin can't reach e.g. os.Remove,
+// os.Setenv or ioutil.WriteFile. Anything that could be used to reach the
+// network, escape the sandbox or block indefinitely is deliberately left
+// out entirely.
+var pluginStdlib = filterSymbols(stdlib.Symbols, map[string][]string{
+	"bytes":         nil,
+	"context":       nil,
+	"fmt":           nil,
+	"io/ioutil":     {"ReadFile", "ReadDir"},
+	"os":            {"Open", "Stat", "Lstat", "ReadDir", "Getenv", "LookupEnv", "IsNotExist", "IsExist", "File", "FileInfo", "FileMode", "DirEntry"},
+	"os/exec":       nil,
+	"path/filepath": nil,
+	"strconv":       nil,
+	"strings":       nil,
+})
+
+// filterSymbols returns the subset of a yaegi symbol table restricted to
+// the given package import paths. A nil symbol list imports the package in
+// full; a non-nil one keeps only the named symbols from that package.
+func filterSymbols(all map[string]map[string]reflect.Value, pkgs map[string][]string) interp.Exports {
+	exports := make(interp.Exports, len(pkgs))
+	for pkg, symbols := range pkgs {
+		syms, ok := all[pkg]
+		if !ok {
+			continue
+		}
+		if symbols == nil {
+			exports[pkg] = syms
+			continue
+		}
+		filtered := make(map[string]reflect.Value, len(symbols))
+		for _, name := range symbols {
+			if v, ok := syms[name]; ok {
+				filtered[name] = v
+			}
+		}
+		exports[pkg] = filtered
+	}
+	return exports
+}
+
+// loadPlugins discovers '*.go' files in dir and wraps each one, through an
+// embedded Go interpreter, into a source.FeatureSource. A plugin that fails
+// to load is logged and skipped so that a single broken plugin does not
+// prevent the worker from starting.
+func loadPlugins(dir string) []source.FeatureSource {
+	sources := []source.FeatureSource{}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			stderrLogger.Printf("WARNING: failed to read plugins directory %q: %v", dir, err)
+		}
+		return sources
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".go") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		s, err := loadPlugin(path)
+		if err != nil {
+			stderrLogger.Printf("WARNING: skipping plugin %q: %v", path, err)
+			continue
+		}
+		stdoutLogger.Printf("loaded plugin source %q from %q", s.Name(), path)
+		sources = append(sources, s)
+	}
+	return sources
+}
+
+// loadPlugin interprets a single plugin file and adapts its exported
+// symbols to the source.FeatureSource interface.
+func loadPlugin(path string) (s *pluginSource, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occurred while loading plugin: %v", r)
+		}
+	}()
+
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := interp.New(interp.Options{})
+	i.Use(pluginStdlib)
+
+	if _, err := i.Eval(string(src)); err != nil {
+		return nil, fmt.Errorf("failed to evaluate plugin: %v", err)
+	}
+
+	discoverVal, err := i.Eval(pluginPackage + ".Discover")
+	if err != nil {
+		return nil, fmt.Errorf("plugin does not export %s.Discover: %v", pluginPackage, err)
+	}
+	discoverFn, ok := discoverVal.Interface().(func(context.Context) (map[string]string, error))
+	if !ok {
+		return nil, fmt.Errorf("%s.Discover has unexpected signature %s", pluginPackage, discoverVal.Type())
+	}
+
+	p := &pluginSource{
+		name:       strings.TrimSuffix(filepath.Base(path), ".go"),
+		path:       path,
+		discoverFn: discoverFn,
+	}
+
+	if v, err := i.Eval(pluginPackage + ".Name"); err == nil {
+		if fn, ok := v.Interface().(func() string); ok {
+			p.name = fn()
+		}
+	}
+	if v, err := i.Eval(pluginPackage + ".NewConfig"); err == nil {
+		if fn, ok := v.Interface().(func() interface{}); ok {
+			p.newConfigFn = fn
+		}
+	}
+	if v, err := i.Eval(pluginPackage + ".SetConfig"); err == nil {
+		if fn, ok := v.Interface().(func(interface{})); ok {
+			p.setConfigFn = fn
+		}
+	}
+
+	return p, nil
+}
+
+// pluginSource adapts a single interpreted plugin to the
+// source.FeatureSource interface, the same way the compiled-in sources
+// under sigs.k8s.io/node-feature-discovery/source implement it.
+type pluginSource struct {
+	name        string
+	path        string
+	discoverFn  func(context.Context) (map[string]string, error)
+	newConfigFn func() interface{}
+	setConfigFn func(interface{})
+	config      interface{}
+	// discovering guards against overlapping calls into discoverFn: Go
+	// cannot forcibly kill a goroutine blocked in a timed-out plugin, so
+	// without this a plugin that hangs past pluginDiscoverTimeout would get
+	// a fresh goroutine re-entering the same (non-reentrant) interpreter on
+	// every subsequent poll.
+	discovering int32
+}
+
+func (s *pluginSource) Name() string { return s.name }
+
+// NewConfig method of the FeatureSource interface. Plugin panics are
+// recovered the same way Discover recovers them.
+func (s *pluginSource) NewConfig() (conf source.Config) {
+	defer func() {
+		if r := recover(); r != nil {
+			stderrLogger.Printf("WARNING: recovered from a panic while creating config for plugin [%s]: %v", s.name, r)
+			conf = nil
+		}
+	}()
+
+	if s.newConfigFn != nil {
+		return s.newConfigFn()
+	}
+	return nil
+}
+
+// GetConfig method of the FeatureSource interface
+func (s *pluginSource) GetConfig() source.Config { return s.config }
+
+// SetConfig method of the FeatureSource interface. configure() calls
+// SetConfig for every source on every config load, including fsnotify-
+// triggered reloads from Run()'s main loop, so a plugin panic here is
+// recovered the same way Discover recovers them - otherwise a bad plugin
+// could crash the whole worker on its next config reload.
+func (s *pluginSource) SetConfig(conf source.Config) {
+	defer func() {
+		if r := recover(); r != nil {
+			stderrLogger.Printf("WARNING: recovered from a panic while setting config for plugin [%s]: %v", s.name, r)
+		}
+	}()
+
+	s.config = conf
+	if s.setConfigFn != nil {
+		s.setConfigFn(conf)
+	}
+}
+
+// discoverResult carries the outcome of a plugin's Discover call back from
+// the goroutine it runs in.
+type discoverResult struct {
+	features map[string]string
+	err      error
+}
+
+// Discover method of the FeatureSource interface. discoverFn is run in its
+// own goroutine with a bounded timeout, so a plugin that never returns times
+// out instead of stalling Run()'s event loop forever. Plugin panics,
+// whether raised directly or after the timeout fires, are recovered the
+// same way getFeatureLabels recovers panics from compiled-in sources.
+func (s *pluginSource) Discover() (features source.Features, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occurred during discovery of plugin [%s]: %v", s.name, r)
+		}
+	}()
+
+	if !atomic.CompareAndSwapInt32(&s.discovering, 0, 1) {
+		return nil, fmt.Errorf("plugin [%s] is still running a previous discovery call that did not return within %s", s.name, pluginDiscoverTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDiscoverTimeout)
+	defer cancel()
+
+	done := make(chan discoverResult, 1)
+	go func() {
+		defer atomic.StoreInt32(&s.discovering, 0)
+		defer func() {
+			if r := recover(); r != nil {
+				done <- discoverResult{err: fmt.Errorf("panic occurred during discovery of plugin [%s]: %v", s.name, r)}
+			}
+		}()
+		raw, err := s.discoverFn(ctx)
+		done <- discoverResult{features: raw, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		features = source.Features{}
+		for k, v := range res.features {
+			features[k] = v
+		}
+		return features, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("plugin [%s] did not return within %s", s.name, pluginDiscoverTimeout)
+	}
+}
@@ -0,0 +1,335 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePluginFile(t *testing.T, dir, name, src string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(src), 0600); err != nil {
+		t.Fatalf("failed to write plugin file %q: %v", path, err)
+	}
+	return path
+}
+
+const helloPlugin = `package plugin
+
+import "context"
+
+func Discover(ctx context.Context) (map[string]string, error) {
+	return map[string]string{"hello": "world"}, nil
+}
+`
+
+const namedPlugin = `package plugin
+
+import "context"
+
+func Name() string {
+	return "myplugin"
+}
+
+func Discover(ctx context.Context) (map[string]string, error) {
+	return map[string]string{"named": "true"}, nil
+}
+`
+
+func TestLoadPluginsDiscoversFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePluginFile(t, dir, "a-hello.go", helloPlugin)
+	writePluginFile(t, dir, "b-named.go", namedPlugin)
+	// Non-.go files must be ignored.
+	writePluginFile(t, dir, "README.md", "not a plugin")
+
+	sources := loadPlugins(dir)
+	if len(sources) != 2 {
+		t.Fatalf("expected 2 plugin sources, got %d", len(sources))
+	}
+
+	// loadPlugins walks ioutil.ReadDir's output, which is sorted by filename,
+	// so "a-hello.go" must be loaded before "b-named.go".
+	if sources[0].Name() != "a-hello" {
+		t.Errorf("expected first source to be named %q, got %q", "a-hello", sources[0].Name())
+	}
+	if sources[1].Name() != "myplugin" {
+		t.Errorf("expected second source's exported Name() to be honored, got %q", sources[1].Name())
+	}
+
+	features, err := sources[0].Discover()
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if features["hello"] != "world" {
+		t.Errorf("unexpected features from plugin: %v", features)
+	}
+
+	features, err = sources[1].Discover()
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if features["named"] != "true" {
+		t.Errorf("unexpected features from plugin: %v", features)
+	}
+}
+
+func TestLoadPluginsMissingDirIsNotAnError(t *testing.T) {
+	sources := loadPlugins(filepath.Join(os.TempDir(), "nfd-worker-plugin-test-does-not-exist"))
+	if len(sources) != 0 {
+		t.Errorf("expected no sources for a missing plugins directory, got %d", len(sources))
+	}
+}
+
+func TestLoadPluginBlocksDisallowedImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writePluginFile(t, dir, "network.go", `package plugin
+
+import (
+	"context"
+	"net"
+)
+
+func Discover(ctx context.Context) (map[string]string, error) {
+	net.Dial("tcp", "example.com:80")
+	return map[string]string{}, nil
+}
+`)
+
+	if _, err := loadPlugin(path); err == nil {
+		t.Fatal("expected loading a plugin that imports \"net\" to fail, since it is outside the curated stdlib sandbox")
+	}
+}
+
+func TestLoadPluginBlocksDisallowedOsSymbol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	okPath := writePluginFile(t, dir, "open.go", `package plugin
+
+import (
+	"context"
+	"os"
+)
+
+func Discover(ctx context.Context) (map[string]string, error) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return map[string]string{"opened": "true"}, nil
+}
+`)
+	if _, err := loadPlugin(okPath); err != nil {
+		t.Errorf("expected a plugin using os.Open to load, got: %v", err)
+	}
+
+	badPath := writePluginFile(t, dir, "remove.go", `package plugin
+
+import (
+	"context"
+	"os"
+)
+
+func Discover(ctx context.Context) (map[string]string, error) {
+	os.Remove("/tmp/whatever")
+	return map[string]string{}, nil
+}
+`)
+	if _, err := loadPlugin(badPath); err == nil {
+		t.Fatal("expected a plugin calling os.Remove to fail to load, since it is outside the curated os symbol allow-list")
+	}
+}
+
+func TestPluginSourceDiscoverTimesOutOnHungPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writePluginFile(t, dir, "hang.go", `package plugin
+
+import "context"
+
+func Discover(ctx context.Context) (map[string]string, error) {
+	select {}
+}
+`)
+	s, err := loadPlugin(path)
+	if err != nil {
+		t.Fatalf("loadPlugin failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := s.Discover(); err == nil {
+			t.Errorf("expected Discover to return a timeout error for a plugin that never returns")
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(pluginDiscoverTimeout + 5*time.Second):
+		t.Fatal("Discover did not return even after the plugin timeout elapsed")
+	}
+}
+
+func TestPluginSourceDiscoverRejectsOverlapAfterTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writePluginFile(t, dir, "hang.go", `package plugin
+
+import "context"
+
+func Discover(ctx context.Context) (map[string]string, error) {
+	select {}
+}
+`)
+	s, err := loadPlugin(path)
+	if err != nil {
+		t.Fatalf("loadPlugin failed: %v", err)
+	}
+
+	// First call times out but leaves its goroutine permanently blocked in
+	// the plugin's own select{}.
+	if _, err := s.Discover(); err == nil {
+		t.Fatal("expected the first call to time out")
+	}
+
+	// A subsequent call, as Run()'s polling loop would make on the next
+	// tick, must not spawn another goroutine into the same interpreter -
+	// it should fail fast instead.
+	if _, err := s.Discover(); err == nil {
+		t.Fatal("expected a second call to reject overlapping with the still-hung first one")
+	}
+}
+
+func TestPluginSourceWhitelistOrdering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePluginFile(t, dir, "named.go", namedPlugin)
+
+	w, err := NewNfdWorker(Args{PluginsDir: dir, Sources: []string{"myplugin"}})
+	if err != nil {
+		t.Fatalf("NewNfdWorker failed: %v", err)
+	}
+	nfd := w.(*nfdWorker)
+
+	if len(nfd.sources) != 1 {
+		t.Fatalf("expected exactly the whitelisted plugin source to be enabled, got %d sources", len(nfd.sources))
+	}
+	if nfd.sources[0].Name() != "myplugin" {
+		t.Errorf("expected enabled source to be %q, got %q", "myplugin", nfd.sources[0].Name())
+	}
+}
+
+func TestLocalSourceStaysLastWithPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePluginFile(t, dir, "named.go", namedPlugin)
+
+	w, err := NewNfdWorker(Args{PluginsDir: dir, Sources: []string{"all"}})
+	if err != nil {
+		t.Fatalf("NewNfdWorker failed: %v", err)
+	}
+	nfd := w.(*nfdWorker)
+
+	if len(nfd.sources) == 0 {
+		t.Fatal("expected at least one source")
+	}
+	// local must be the last source so it can override labels from other
+	// sources, including plugins.
+	if last := nfd.sources[len(nfd.sources)-1]; last.Name() != "local" {
+		t.Errorf("expected %q to be the last source, got %q", "local", last.Name())
+	}
+}
+
+func TestPluginSourceWhitelistExcludesUnlistedPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-plugin-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePluginFile(t, dir, "named.go", namedPlugin)
+
+	w, err := NewNfdWorker(Args{PluginsDir: dir, Sources: []string{"cpu"}})
+	if err != nil {
+		t.Fatalf("NewNfdWorker failed: %v", err)
+	}
+	nfd := w.(*nfdWorker)
+
+	for _, s := range nfd.sources {
+		if s.Name() == "myplugin" {
+			t.Fatalf("plugin source should not be enabled unless listed in --sources")
+		}
+	}
+}
+
+func TestPluginSourceSetConfigRecoversPanic(t *testing.T) {
+	s := &pluginSource{
+		name:        "panicky",
+		setConfigFn: func(interface{}) { panic("boom") },
+	}
+
+	// A panicking plugin must not bring down the whole worker - SetConfig is
+	// called for every source on every config load/reload.
+	s.SetConfig(map[string]string{"a": "b"})
+}
+
+func TestPluginSourceNewConfigRecoversPanic(t *testing.T) {
+	s := &pluginSource{
+		name:        "panicky",
+		newConfigFn: func() interface{} { panic("boom") },
+	}
+
+	if conf := s.NewConfig(); conf != nil {
+		t.Errorf("expected NewConfig to return nil after recovering from a panic, got %v", conf)
+	}
+}
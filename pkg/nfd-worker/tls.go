@@ -0,0 +1,155 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// tlsCache holds the currently active TLS client certificate and trusted CA
+// pool used for the gRPC connection to nfd-master. Both are refreshed in
+// place by nfdWorker.reloadTLS() whenever the underlying files change on
+// disk, so a rotated certificate takes effect without a worker restart.
+type tlsCache struct {
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+	caHash [sha256.Size]byte
+}
+
+// getClientCertificate implements tls.Config.GetClientCertificate, handing
+// out the most recently loaded client keypair on every handshake.
+func (c *tlsCache) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, fmt.Errorf("no client certificate loaded")
+	}
+	return c.cert, nil
+}
+
+// verifyConnection implements tls.Config.VerifyConnection, verifying the
+// server's chain against the live CA pool instead of the one captured in the
+// tls.Config at dial time. Unlike VerifyPeerCertificate, it also receives the
+// negotiated ServerName, so the peer's identity is checked alongside its
+// chain - required since InsecureSkipVerify disables Go's own hostname
+// check.
+func (c *tlsCache) verifyConnection(cs tls.ConnectionState) error {
+	c.mu.RLock()
+	pool := c.pool
+	c.mu.RUnlock()
+
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no peer certificate presented")
+	}
+
+	opts := x509.VerifyOptions{Roots: pool, Intermediates: x509.NewCertPool(), DNSName: cs.ServerName}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// update swaps in a newly loaded keypair and CA pool, returning whether the
+// CA pool changed compared to what was previously cached.
+func (c *tlsCache) update(cert *tls.Certificate, pool *x509.CertPool, caPEM []byte) bool {
+	hash := sha256.Sum256(caPEM)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.pool == nil || hash != c.caHash
+	c.cert = cert
+	c.pool = pool
+	c.caHash = hash
+	return changed
+}
+
+// loadTLSMaterial reads the client keypair and assembles the trusted CA
+// pool from caFile plus every PEM file found in caBundleDir, e.g. a
+// cluster-wide trusted-ca-bundle ConfigMap mounted alongside the worker.
+func loadTLSMaterial(certFile, keyFile, caFile, caBundleDir string) (*tls.Certificate, *x509.CertPool, []byte, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	var caPEM []byte
+
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read root certificate file: %v", err)
+		}
+		if ok := pool.AppendCertsFromPEM(data); !ok {
+			return nil, nil, nil, fmt.Errorf("failed to add certificate from %q", caFile)
+		}
+		caPEM = append(caPEM, data...)
+	}
+
+	if caBundleDir != "" {
+		bundled, err := loadCABundleDir(caBundleDir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, data := range bundled {
+			if ok := pool.AppendCertsFromPEM(data); !ok {
+				stderrLogger.Printf("WARNING: no valid certificates found while parsing a file in %q", caBundleDir)
+				continue
+			}
+			caPEM = append(caPEM, data...)
+		}
+	}
+
+	return &cert, pool, caPEM, nil
+}
+
+// loadCABundleDir reads every regular file in dir, in deterministic order,
+// so that e.g. a mounted trusted-ca-bundle ConfigMap is picked up in full.
+func loadCABundleDir(dir string) ([][]byte, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle directory %q: %v", dir, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	files := make([][]byte, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %v", path, err)
+		}
+		files = append(files, data)
+	}
+	return files, nil
+}
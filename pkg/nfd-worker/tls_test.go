@@ -0,0 +1,298 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfdworker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	pb "sigs.k8s.io/node-feature-discovery/pkg/labeler"
+)
+
+// testCA is a minimal self-signed CA used to mint server/client leaf
+// certificates for the TLS reload tests below.
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue mints a leaf certificate, valid for both server and client auth,
+// signed by the CA, and writes it and its key as PEM files under dir.
+func (ca *testCA) issue(t *testing.T, dir, name, cn string) (certFile, keyFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate leaf key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create leaf certificate: %v", err)
+	}
+
+	certFile = filepath.Join(dir, name+"-cert.pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %q: %v", path, err)
+	}
+}
+
+// fakeLabelerServer records the last SetLabels request it received.
+type fakeLabelerServer struct {
+	requests chan *pb.SetLabelsRequest
+}
+
+func (s *fakeLabelerServer) SetLabels(_ context.Context, r *pb.SetLabelsRequest) (*pb.SetLabelsReply, error) {
+	s.requests <- r
+	return &pb.SetLabelsReply{}, nil
+}
+
+// startFakeMaster starts a TLS-secured, mutually authenticated gRPC Labeler
+// server on addr, trusting clientCA for client certificates.
+func startFakeMaster(t *testing.T, addr string, serverCertFile, serverKeyFile string, clientCA *testCA) (*grpc.Server, *fakeLabelerServer, string) {
+	cert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatalf("failed to load server certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA.cert)
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %v", addr, err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	fake := &fakeLabelerServer{requests: make(chan *pb.SetLabelsRequest, 1)}
+	pb.RegisterLabelerServer(srv, fake)
+
+	go srv.Serve(lis)
+
+	return srv, fake, lis.Addr().String()
+}
+
+// TestTLSReload verifies that rotating the worker's TLS keypair and CA file
+// on disk is picked up by reloadTLS(), and that a changed CA pool triggers
+// a fresh connection to nfd-master that uses the new material end-to-end.
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfd-worker-tls-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caA := newTestCA(t, "ca-a")
+	serverCertFile, serverKeyFile := caA.issue(t, dir, "server-a", "master")
+	clientCertFile, clientKeyFile := caA.issue(t, dir, "client-a", "worker")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, caA.pem, 0600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	srv, fake, addr := startFakeMaster(t, "127.0.0.1:0", serverCertFile, serverKeyFile, caA)
+	defer srv.Stop()
+
+	w := &nfdWorker{
+		args: Args{
+			Server:   addr,
+			CertFile: clientCertFile,
+			KeyFile:  clientKeyFile,
+			CaFile:   caFile,
+		},
+		config:   &NFDConfig{},
+		tlsCache: &tlsCache{},
+	}
+
+	if err := w.connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer w.disconnect()
+
+	if err := advertiseFeatureLabels(w.client, Labels{"feature": "true"}, nil); err != nil {
+		t.Fatalf("initial SetLabels failed: %v", err)
+	}
+	select {
+	case r := <-fake.requests:
+		if r.Labels["feature"] != "true" {
+			t.Fatalf("unexpected labels in initial request: %v", r.Labels)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for initial SetLabels request")
+	}
+
+	// Rotate to a brand new CA, re-issuing both the server and client
+	// certificates under it, and restart the fake master with the new
+	// server material - simulating a full cert/CA rotation.
+	srv.Stop()
+	caB := newTestCA(t, "ca-b")
+	newServerCertFile, newServerKeyFile := caB.issue(t, dir, "server-b", "master")
+	newClientCertFile, newClientKeyFile := caB.issue(t, dir, "client-b", "worker")
+
+	if err := copyFile(newServerCertFile, serverCertFile); err != nil {
+		t.Fatalf("failed to rotate server cert: %v", err)
+	}
+	if err := copyFile(newServerKeyFile, serverKeyFile); err != nil {
+		t.Fatalf("failed to rotate server key: %v", err)
+	}
+	if err := copyFile(newClientCertFile, clientCertFile); err != nil {
+		t.Fatalf("failed to rotate client cert: %v", err)
+	}
+	if err := copyFile(newClientKeyFile, clientKeyFile); err != nil {
+		t.Fatalf("failed to rotate client key: %v", err)
+	}
+	if err := ioutil.WriteFile(caFile, caB.pem, 0600); err != nil {
+		t.Fatalf("failed to rotate CA file: %v", err)
+	}
+
+	srv2, fake2, _ := startFakeMaster(t, addr, serverCertFile, serverKeyFile, caB)
+	defer srv2.Stop()
+
+	if err := w.reloadTLS(); err != nil {
+		t.Fatalf("reloadTLS failed: %v", err)
+	}
+	if w.clientConn == nil {
+		t.Fatal("expected reloadTLS to re-establish the connection after a CA change")
+	}
+
+	if err := advertiseFeatureLabels(w.client, Labels{"feature": "rotated"}, nil); err != nil {
+		t.Fatalf("post-rotation SetLabels failed: %v", err)
+	}
+	select {
+	case r := <-fake2.requests:
+		if r.Labels["feature"] != "rotated" {
+			t.Fatalf("unexpected labels in post-rotation request: %v", r.Labels)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for post-rotation SetLabels request using the new TLS material")
+	}
+}
+
+// TestVerifyConnectionRejectsWrongIdentity guards against the regression
+// where the server's chain was checked against the live CA pool but its
+// identity was not, letting any certificate signed by a configured CA -
+// including one pulled in from --ca-bundle-dir - impersonate nfd-master as
+// long as it carried an unrelated CN/DNS name.
+func TestVerifyConnectionRejectsWrongIdentity(t *testing.T) {
+	ca := newTestCA(t, "ca")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate leaf key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "evil.attacker.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"evil.attacker.example"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create leaf certificate: %v", err)
+	}
+	evilCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse leaf certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	c := &tlsCache{pool: pool}
+
+	err = c.verifyConnection(tls.ConnectionState{
+		ServerName:       "nfd-master.openshift-nfd.svc",
+		PeerCertificates: []*x509.Certificate{evilCert},
+	})
+	if err == nil {
+		t.Fatal("expected a certificate for an unrelated DNS name to be rejected, even though it was signed by a trusted CA")
+	}
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0600)
+}